@@ -5,13 +5,22 @@ program will exit with a non-zero exit code and print a message.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
-	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/araddon/gou"
 )
@@ -31,13 +40,44 @@ func main() {
 	flag.BoolVar(&colorize, "c", true, `colorize output`)
 	flag.BoolVar(&verbose, "v", false, `verbose output`)
 	raceFlag := flag.Bool("race", false, `Run "go test" with "race" flag`)
+	nFlag := flag.Int("n", runtime.NumCPU(), "number of directories to test/build in parallel")
+	timeoutFlag := flag.Duration("timeout", 0, `Timeout for each "go test"/"go build" invocation (0 means no timeout)`)
+	jsonFlag := flag.Bool("json", false, `Emit line-delimited JSON TestEvents (like "go test -json") instead of human-readable output`)
+	shardFlag := flag.Int("shard", 0, "Which shard to run, in [0, shards) (see -shards)")
+	shardsFlag := flag.Int("shards", 1, "Split directories into this many shards and only run -shard's")
+	targetFlag := flag.String("target", "", "goos/goarch to cross-compile every package for, e.g. linux/arm64 (forces -buildOnly)")
+	tagsFlag := flag.String("tags", "", `Build tags to pass to "go build"/"go test" (-tags)`)
 	flag.Parse()
 
+	if *shardFlag < 0 || *shardsFlag < 1 || *shardFlag >= *shardsFlag {
+		gou.Errorf("-shard must be in [0, shards), got -shard=%d -shards=%d", *shardFlag, *shardsFlag)
+		os.Exit(1)
+	}
+
+	buildOnly := *buildOnlyFlag
+	var goos, goarch string
+	if *targetFlag != "" {
+		parts := strings.SplitN(*targetFlag, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			gou.Errorf("-target must be of the form goos/goarch, got %q", *targetFlag)
+			os.Exit(1)
+		}
+		goos, goarch = parts[0], parts[1]
+		buildOnly = true
+	}
+
 	gou.SetLogger(log.New(os.Stderr, "", 0), "debug")
 	if colorize {
 		gou.SetColorIfTerminal()
 	}
 
+	// With -v, directories run one at a time. (Output is printed in
+	// directory-discovery order at any worker count; see runJobs.)
+	workers := *nFlag
+	if verbose {
+		workers = 1
+	}
+
 	skipDirNames := strings.Split(*skipDirFlag, ",")
 	skipDirStats := make([]os.FileInfo, 0)
 	for _, skipDirName := range skipDirNames {
@@ -54,115 +94,471 @@ func main() {
 		skipDirStats = append(skipDirStats, stat)
 	}
 
-	conf := NewConf(skipDirStats, *buildOnlyFlag, *shortFlag, *raceFlag)
-	failedDirs := RunTestsRecursively(baseDir, baseDir, conf)
+	conf := NewConf(skipDirStats, buildOnly, *shortFlag, *raceFlag, *jsonFlag, *tagsFlag, goos, goarch)
+	failedDirs, timedOutDirs := RunTestsRecursively(baseDir, baseDir, conf, workers, *timeoutFlag, *shardFlag, *shardsFlag)
 
+	if *shardsFlag > 1 {
+		gou.Infof("ran shard %d of %d", *shardFlag, *shardsFlag)
+	}
+	if len(timedOutDirs) > 0 {
+		gou.Error("\nTimed out directories:")
+		for _, dir := range timedOutDirs {
+			gou.Errorf("  %s", dir)
+		}
+	}
 	if len(failedDirs) > 0 {
 		gou.Error("\nFailed directories:")
 		for _, dir := range failedDirs {
 			gou.Errorf("  %s", dir)
 		}
+	}
+	if len(failedDirs) > 0 || len(timedOutDirs) > 0 {
 		os.Exit(1)
-	} else {
-		gou.Info("\nall tests/builds succeeded")
 	}
+	gou.Info("\nall tests/builds succeeded")
 }
 
-func RunTestsRecursively(rootDir, dirName string, conf *Conf) []string {
+// dirJob is a single directory that needs "go test" or "go build" run in it.
+type dirJob struct {
+	path string
+	opts []string
+	kind string // "test" or "build"
+	pkg  string // path relative to the directory Walk started from, used as the Package field in -json mode
+}
 
-	if strings.Contains(dirName, "trash") {
+// dirResult is the outcome of running a dirJob.
+type dirResult struct {
+	path     string
+	output   []byte
+	err      error
+	elapsed  time.Duration
+	timedOut bool
+	events   []TestEvent // populated only when conf.jsonOutput is set; output then holds just stderr
+}
+
+// TestEvent mirrors the JSON schema "go test -json" emits on stdout, so
+// alltest's own -json output can be consumed by the same tooling (e.g.
+// gotestsum) without any special-casing.
+type TestEvent struct {
+	Time    time.Time `json:"Time"`
+	Action  string    `json:"Action"`
+	Package string    `json:"Package,omitempty"`
+	Test    string    `json:"Test,omitempty"`
+	Elapsed float64   `json:"Elapsed,omitempty"`
+	Output  string    `json:"Output,omitempty"`
+}
+
+// RunTestsRecursively walks the tree rooted at dirName, discovering every
+// directory that needs "go test" or "go build" run, then executes those
+// runs across a pool of workers workers wide, each bounded by timeout (0
+// means no timeout). If shards > 1, only the directories belonging to shard
+// are run, so that N cooperating invocations of alltest (one per shard) can
+// split up a tree between them. Each directory's output is printed in the
+// same order the directories were discovered, regardless of which worker
+// finished first: a directory's output is printed once it and every
+// directory discovered before it have finished. It returns the failed
+// directories and, separately, the directories that timed out.
+func RunTestsRecursively(rootDir, dirName string, conf *Conf, workers int, timeout time.Duration, shard, shards int) ([]string, []string) {
+	jobs := collectDirs(dirName, conf)
+	jobs = shardJobs(jobs, shard, shards)
+
+	jsonEnc := json.NewEncoder(os.Stdout)
+
+	failures := []string{}
+	timeouts := []string{}
+	runJobs(jobs, workers, timeout, conf.jsonOutput, conf.goos, conf.goarch, func(res dirResult) {
+		thisDirPath := strings.Replace(res.path, rootDir, "", -1)
+		if conf.jsonOutput {
+			for _, ev := range res.events {
+				jsonEnc.Encode(ev)
+			}
+		}
+		switch {
+		case res.timedOut:
+			if !conf.jsonOutput {
+				gou.Errorf("Timed out: %s (%s)", thisDirPath, res.elapsed)
+			}
+			timeouts = append(timeouts, thisDirPath)
+		case res.err != nil:
+			if !conf.jsonOutput {
+				if len(res.output) > 0 {
+					gou.Errorf("%s", res.output)
+				}
+				gou.Errorf("Failed:   %s (%s)", thisDirPath, res.elapsed)
+			}
+			failures = append(failures, thisDirPath)
+		case verbose && len(res.output) > 0 && !conf.jsonOutput:
+			gou.Debug(string(res.output))
+			gou.Infof("Success   %s (%s)", thisDirPath, res.elapsed)
+		}
+	})
+	return failures, timeouts
+}
+
+// Package is a directory discovered by Walk that needs a "go test" or
+// "go build" run.
+type Package struct {
+	Path string // absolute directory path
+	Pkg  string // path relative to the walk root
+	Kind string // "test" or "build"
+}
+
+// Walk discovers every directory under root that needs a "go test" or
+// "go build" run, honoring conf's skip list, .alltestignore files, and
+// -buildOnly. It uses filepath.WalkDir plus os.ReadDir rather than a
+// hand-rolled recursion so each directory costs one readdir instead of a
+// stat per entry, and skip-dir/.alltestignore handling happens in the same
+// single pass as discovery.
+func Walk(root string, conf *Conf) ([]Package, error) {
+	pkgs := []Package{}
+	err := filepath.WalkDir(root, func(dirName string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if shouldSkipDir(dirName, conf) {
+			return filepath.SkipDir
+		}
+
+		entries, err := os.ReadDir(dirName)
+		if err != nil {
+			return err
+		}
+
+		anyTestsInDir := false
+		anyGoSrcsInDir := false
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			if strings.HasSuffix(entry.Name(), "_test.go") {
+				anyTestsInDir = true
+			} else if strings.HasSuffix(entry.Name(), ".go") {
+				anyGoSrcsInDir = true
+			}
+		}
+
+		kind := ""
+		switch {
+		case anyTestsInDir && !conf.buildOnly:
+			kind = "test"
+		case anyGoSrcsInDir:
+			kind = "build"
+		default:
+			return nil
+		}
+
+		pkgs = append(pkgs, Package{
+			Path: dirName,
+			Pkg:  strings.Replace(dirName, root, "", -1),
+			Kind: kind,
+		})
 		return nil
+	})
+	return pkgs, err
+}
+
+// shouldSkipDir reports whether dirName should be excluded from discovery:
+// because its path contains "trash", because it was named on -skip, or
+// because it contains a .alltestignore file.
+func shouldSkipDir(dirName string, conf *Conf) bool {
+	if strings.Contains(dirName, "trash") {
+		return true
 	}
-	// Skip this directory if the user requested that we skip it
 	stat, err := os.Stat(dirName)
 	quitIfErr(err)
 	for _, skipDir := range conf.skipDirs {
 		if os.SameFile(stat, skipDir) {
 			gou.Debugf("skipping directory %s as requested", dirName)
-			return []string{}
+			return true
 		}
 	}
-	// Skip this directory if the user entered a .alltestignore file
-	_, err = os.Stat(path.Join(dirName, ".alltestignore"))
-	if err == nil {
-		// If err == nil that means we found a file, thus should bail
+	if _, err := os.Stat(filepath.Join(dirName, ".alltestignore")); err == nil {
 		gou.Debugf("skipping directory %s as requested due to ignore file", dirName)
-		return []string{}
+		return true
 	}
+	return false
+}
 
-	infos, err := ioutil.ReadDir(dirName)
+// collectDirs discovers the directories under dirName that need a "go
+// test" or "go build" run and turns each into a dirJob with the "go"
+// command-line arguments conf calls for.
+func collectDirs(dirName string, conf *Conf) []*dirJob {
+	pkgs, err := Walk(dirName, conf)
 	quitIfErr(err)
 
-	failures := []string{}
-
-	anyTestsInDir := false
-	anyGoSrcsInDir := false
-	for _, info := range infos {
-		if info.IsDir() {
-			// Recursively run the tests in each subdirectory
-			subDirName := path.Join(dirName, info.Name())
-			failedSubDirs := RunTestsRecursively(rootDir, subDirName, conf)
-			failures = append(failures, failedSubDirs...)
-		} else if isTestFile(info) {
-			anyTestsInDir = true
-		} else if isGoFile(info) {
-			anyGoSrcsInDir = true
-		}
+	jobs := make([]*dirJob, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		jobs = append(jobs, newDirJob(pkg, conf))
 	}
+	return jobs
+}
 
-	goRunOpts := []string{"test"}
-
-	// Run "go test" in this directory if it has any tests
-	if anyTestsInDir && !conf.buildOnly {
+// newDirJob builds the dirJob -- the actual "go" command-line arguments --
+// for a Package, given conf's flags.
+func newDirJob(pkg Package, conf *Conf) *dirJob {
+	goRunOpts := []string{"build"}
+	if pkg.Kind == "test" {
+		goRunOpts = []string{"test"}
+		if conf.jsonOutput {
+			goRunOpts = append(goRunOpts, "-json")
+		}
 		if conf.short {
 			goRunOpts = append(goRunOpts, "-short")
 		}
 		if conf.race {
 			goRunOpts = append(goRunOpts, "-race")
 		}
-	} else if anyGoSrcsInDir {
-		goRunOpts = []string{"build"}
+	}
+	if conf.tags != "" {
+		goRunOpts = append(goRunOpts, "-tags", conf.tags)
+	}
+
+	return &dirJob{path: pkg.Path, opts: goRunOpts, kind: pkg.Kind, pkg: pkg.Pkg}
+}
+
+// shardJobs selects the subset of jobs belonging to shard, out of shards
+// total shards, by hashing each job's package path with FNV-1a. Hashing the
+// path (rather than e.g. its index in jobs) keeps the assignment stable as
+// unrelated directories are added or removed elsewhere in the tree.
+func shardJobs(jobs []*dirJob, shard, shards int) []*dirJob {
+	if shards <= 1 {
+		return jobs
+	}
+	sharded := []*dirJob{}
+	for _, job := range jobs {
+		h := fnv.New32a()
+		h.Write([]byte(job.pkg))
+		if int(h.Sum32()%uint32(shards)) == shard {
+			sharded = append(sharded, job)
+		}
+	}
+	return sharded
+}
+
+// jobItem pairs a dirJob with its position in the original, discovery-ordered
+// job list, so results can be reassembled in that same order once the worker
+// pool has run them out of order.
+type jobItem struct {
+	idx int
+	job *dirJob
+}
+
+// resultItem is a dirResult tagged with the jobItem index it came from.
+type resultItem struct {
+	idx int
+	res dirResult
+}
+
+// runJobs runs jobs across workers goroutines, each invocation bounded by
+// timeout (0 means no timeout). Results arrive out of order as workers
+// finish, but runJobs holds each one back in a small pending buffer and
+// calls process on it only once every lower-indexed job has already been
+// processed, so process always sees jobs in the same order jobs was given
+// in. A finished job waits only on the lower-indexed jobs still running,
+// not on the whole pool.
+func runJobs(jobs []*dirJob, workers int, timeout time.Duration, jsonOutput bool, goos, goarch string, process func(dirResult)) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobCh := make(chan jobItem)
+	resCh := make(chan resultItem)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobCh {
+				resCh <- resultItem{item.idx, runDir(item.job, timeout, jsonOutput, goos, goarch)}
+			}
+		}()
+	}
+
+	go func() {
+		for i, job := range jobs {
+			jobCh <- jobItem{idx: i, job: job}
+		}
+		close(jobCh)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resCh)
+	}()
+
+	pending := make(map[int]dirResult)
+	next := 0
+	for r := range resCh {
+		pending[r.idx] = r.res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			process(res)
+			delete(pending, next)
+			next++
+		}
+	}
+}
+
+// runDir runs a single dirJob's "go test"/"go build" invocation, using the
+// Dir field on exec.Command rather than os.Chdir so directories can safely
+// run concurrently. Outside -json mode, stdout and stderr are combined so
+// panics and race detector reports actually show up on failure; in -json
+// mode stderr is kept apart and folded into the events by testEvents.
+//
+// If timeout is non-zero and the invocation runs past it, the invocation is
+// killed -- on unix with a SIGKILL to its whole process group (go test
+// binaries commonly survive a kill of just the parent process), on windows
+// by killing only the go process itself; see procgroup_unix.go and
+// procgroup_other.go.
+func runDir(job *dirJob, timeout time.Duration, jsonOutput bool, goos, goarch string) dirResult {
+	start := time.Now()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "go", job.opts...)
+	cmd.Dir = job.path
+	setPgid(cmd)
+	if goos != "" || goarch != "" {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("GOOS=%s", goos), fmt.Sprintf("GOARCH=%s", goarch))
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	if jsonOutput {
+		cmd.Stderr = &stderr
 	} else {
-		return failures
+		cmd.Stderr = &stdout
 	}
-	err = os.Chdir(dirName)
-	quitIfErr(err)
-	bytes, err := exec.Command("go", goRunOpts...).Output()
-	if len(bytes) > 0 && bytes[len(bytes)-1] == '\n' {
+
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+			err = <-done
+		}
+	}
+
+	elapsed := time.Since(start)
+	timedOut := ctx.Err() == context.DeadlineExceeded
+
+	if jsonOutput {
+		return dirResult{
+			path:     job.path,
+			output:   stderr.Bytes(),
+			err:      err,
+			elapsed:  elapsed,
+			timedOut: timedOut,
+			events:   testEvents(job, &stdout, &stderr, err, elapsed),
+		}
+	}
+
+	output := stdout.Bytes()
+	if len(output) > 0 && output[len(output)-1] == '\n' {
 		// lets get rid of last new line at end of this
-		bytes = bytes[0 : len(bytes)-2]
+		output = output[0 : len(output)-1]
 	}
 
-	thisDirPath := strings.Replace(dirName, rootDir, "", -1)
-	if err != nil {
-		if len(bytes) > 0 {
-			gou.Errorf(string(bytes))
+	return dirResult{
+		path:     job.path,
+		output:   output,
+		err:      err,
+		elapsed:  elapsed,
+		timedOut: timedOut,
+	}
+}
+
+// testEvents turns a finished dirJob's raw output into a stream of
+// TestEvents. "go test -json" already emits this schema on stdout, so for a
+// test job we just decode it line-by-line and re-tag each event with the
+// package path alltest discovered (rather than whatever import path "go
+// test" itself resolved). For a "go build" job, which has no -json support
+// and writes any compile errors to stderr rather than stdout, we synthesize
+// the equivalent start/output/pass-or-fail events ourselves.
+func testEvents(job *dirJob, stdout, stderr *bytes.Buffer, err error, elapsed time.Duration) []TestEvent {
+	if job.kind != "test" {
+		events := []TestEvent{{Time: time.Now(), Action: "start", Package: job.pkg}}
+		if stderr.Len() > 0 {
+			events = append(events, TestEvent{Time: time.Now(), Action: "output", Package: job.pkg, Output: stderr.String()})
 		}
-		gou.Errorf("Failed:   %s", thisDirPath)
-		failures = append(failures, thisDirPath)
-	} else {
-		if verbose && len(bytes) > 0 {
-			gou.Debug(string(bytes))
-			gou.Infof("Success   %s", thisDirPath)
+		action := "pass"
+		if err != nil {
+			action = "fail"
 		}
+		events = append(events, TestEvent{Time: time.Now(), Action: action, Package: job.pkg, Elapsed: elapsed.Seconds()})
+		return events
+	}
 
+	events := []TestEvent{}
+	sawResult := false
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var ev TestEvent
+		if jsonErr := json.Unmarshal([]byte(line), &ev); jsonErr == nil {
+			ev.Package = job.pkg
+			if ev.Test == "" && (ev.Action == "pass" || ev.Action == "fail") {
+				sawResult = true
+			}
+		} else {
+			ev = TestEvent{Time: time.Now(), Action: "output", Package: job.pkg, Output: line + "\n"}
+		}
+		events = append(events, ev)
+	}
+
+	// go test itself only ever writes its -json protocol to stdout, but it
+	// still writes some diagnostics straight to stderr (e.g. vet failures,
+	// or a compile error that keeps it from emitting any -json at all) --
+	// fold that into the stream rather than dropping it.
+	if stderr.Len() > 0 {
+		events = append(events, TestEvent{Time: time.Now(), Action: "output", Package: job.pkg, Output: stderr.String()})
+	}
+	if !sawResult {
+		action := "pass"
+		if err != nil {
+			action = "fail"
+		}
+		events = append(events, TestEvent{Time: time.Now(), Action: action, Package: job.pkg, Elapsed: elapsed.Seconds()})
 	}
-	return failures
+	return events
 }
 
 type Conf struct {
-	skipDirs  []os.FileInfo
-	buildOnly bool
-	short     bool
-	race      bool
+	skipDirs   []os.FileInfo
+	buildOnly  bool
+	short      bool
+	race       bool
+	jsonOutput bool
+	tags       string
+	goos       string
+	goarch     string
 }
 
-func NewConf(skipDirs []os.FileInfo, buildOnly, short, race bool) *Conf {
+func NewConf(skipDirs []os.FileInfo, buildOnly, short, race, jsonOutput bool, tags, goos, goarch string) *Conf {
 	return &Conf{
-		skipDirs:  skipDirs,
-		buildOnly: buildOnly,
-		short:     short,
-		race:      race,
+		skipDirs:   skipDirs,
+		buildOnly:  buildOnly,
+		short:      short,
+		race:       race,
+		jsonOutput: jsonOutput,
+		tags:       tags,
+		goos:       goos,
+		goarch:     goarch,
 	}
 }
 
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	root := t.TempDir()
+
+	mustWriteFile(t, filepath.Join(root, "buildpkg", "main.go"), "package buildpkg\n")
+	mustWriteFile(t, filepath.Join(root, "testpkg", "thing.go"), "package testpkg\n")
+	mustWriteFile(t, filepath.Join(root, "testpkg", "thing_test.go"), "package testpkg\n")
+	mustWriteFile(t, filepath.Join(root, "skipped", "main.go"), "package skipped\n")
+	mustWriteFile(t, filepath.Join(root, "ignored", "main.go"), "package ignored\n")
+	mustWriteFile(t, filepath.Join(root, "ignored", ".alltestignore"), "")
+	mustWriteFile(t, filepath.Join(root, "empty", "README.md"), "not go\n")
+
+	skipStat, err := os.Stat(filepath.Join(root, "skipped"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		buildOnly bool
+		want      map[string]string // pkg -> kind
+	}{
+		{
+			name: "default",
+			want: map[string]string{
+				"/buildpkg": "build",
+				"/testpkg":  "test",
+			},
+		},
+		{
+			name:      "buildOnly",
+			buildOnly: true,
+			want: map[string]string{
+				"/buildpkg": "build",
+				"/testpkg":  "build",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := NewConf([]os.FileInfo{skipStat}, tt.buildOnly, false, false, false, "", "", "")
+			pkgs, err := Walk(root, conf)
+			if err != nil {
+				t.Fatalf("Walk: %s", err)
+			}
+
+			got := map[string]string{}
+			for _, pkg := range pkgs {
+				got[pkg.Pkg] = pkg.Kind
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d packages %v, want %d %v", len(got), got, len(tt.want), tt.want)
+			}
+			for pkg, kind := range tt.want {
+				if got[pkg] != kind {
+					t.Errorf("pkg %s: got kind %q, want %q", pkg, got[pkg], kind)
+				}
+			}
+		})
+	}
+}
+
+func mustWriteFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardJobs(t *testing.T) {
+	jobs := make([]*dirJob, 0, 20)
+	for i := 0; i < 20; i++ {
+		jobs = append(jobs, &dirJob{pkg: fmt.Sprintf("/pkg%02d", i)})
+	}
+
+	const shards = 4
+	seen := map[string]int{}
+	total := 0
+	for shard := 0; shard < shards; shard++ {
+		sharded := shardJobs(jobs, shard, shards)
+		total += len(sharded)
+		for _, job := range sharded {
+			seen[job.pkg]++
+		}
+	}
+
+	if total != len(jobs) {
+		t.Fatalf("shards partitioned %d jobs total, want %d", total, len(jobs))
+	}
+	for _, job := range jobs {
+		if seen[job.pkg] != 1 {
+			t.Errorf("pkg %s assigned to %d shards, want exactly 1", job.pkg, seen[job.pkg])
+		}
+	}
+
+	// Partitioning is a pure function of the package path, so re-running it
+	// must assign every job to the same shard again.
+	for shard := 0; shard < shards; shard++ {
+		first := shardJobs(jobs, shard, shards)
+		again := shardJobs(jobs, shard, shards)
+		if len(again) != len(first) {
+			t.Fatalf("shard %d: non-deterministic partition size", shard)
+		}
+		for i := range first {
+			if again[i].pkg != first[i].pkg {
+				t.Errorf("shard %d: job %d is %s on one run and %s on the next", shard, i, first[i].pkg, again[i].pkg)
+			}
+		}
+	}
+
+	if got := shardJobs(jobs, 0, 1); len(got) != len(jobs) {
+		t.Errorf("shards=1 should return all jobs unsharded, got %d want %d", len(got), len(jobs))
+	}
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// setPgid is a no-op on windows, which has no process-group equivalent to
+// Setpgid.
+func setPgid(cmd *exec.Cmd) {}
+
+// killProcessGroup falls back to killing just cmd's own process, since
+// windows has no process-group kill.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}